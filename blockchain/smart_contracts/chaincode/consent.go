@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ConsentGrant is a time-bounded, purpose-scoped authorization a patient
+// issues over one of their records, replacing the permanent, all-or-nothing
+// entries that ShareEHRRecord used to append to EHRRecord.Permissions.
+type ConsentGrant struct {
+	ID             string    `json:"id"`
+	RecordID       string    `json:"recordId"`
+	GranteeID      string    `json:"granteeId"`
+	Purpose        string    `json:"purpose"` // e.g. "treatment", "research", "billing"
+	AllowedActions []string  `json:"allowedActions"`
+	NotBefore      time.Time `json:"notBefore"`
+	NotAfter       time.Time `json:"notAfter"`
+	MaxUses        int       `json:"maxUses"` // 0 means unlimited
+	UsesRemaining  int       `json:"usesRemaining"`
+	Revoked        bool      `json:"revoked"`
+	Expired        bool      `json:"expired"`
+}
+
+// consentKey returns the world-state key for a consent grant.
+func consentKey(ctx contractapi.TransactionContextInterface, grantID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("consent", []string{grantID})
+}
+
+// txTimestamp returns the transaction's deterministic timestamp so that
+// every endorsing peer evaluates consent windows identically.
+func txTimestamp(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read tx timestamp: %v", err)
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// GrantConsent issues a new time-bounded, purpose-scoped consent grant over
+// recordID. Only the patient who owns the record, as identified by their
+// client certificate, or someone the role registry grants sharing access to,
+// may grant consent.
+func (c *EHRContract) GrantConsent(ctx contractapi.TransactionContextInterface, grantID string, recordID string, granteeID string, purpose string, allowedActions []string, notBefore time.Time, notAfter time.Time, maxUses int) error {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != record.PatientID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "share")
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("only the patient can grant consent for record %s", recordID)
+		}
+	}
+	if notAfter.Before(notBefore) {
+		return fmt.Errorf("notAfter must not be before notBefore")
+	}
+
+	key, err := consentKey(ctx, grantID)
+	if err != nil {
+		return fmt.Errorf("failed to build consent key: %v", err)
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("consent grant %s already exists", grantID)
+	}
+
+	grant := ConsentGrant{
+		ID:             grantID,
+		RecordID:       recordID,
+		GranteeID:      granteeID,
+		Purpose:        purpose,
+		AllowedActions: allowedActions,
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		MaxUses:        maxUses,
+		UsesRemaining:  maxUses,
+	}
+
+	if err := c.putConsentGrant(ctx, grant); err != nil {
+		return err
+	}
+
+	return c.emitConsentEvent(ctx, "ConsentGranted", grant)
+}
+
+// RevokeConsent revokes a consent grant before its natural expiry. Only the
+// patient who owns the underlying record, or someone the role registry
+// grants sharing access to, may revoke it.
+func (c *EHRContract) RevokeConsent(ctx contractapi.TransactionContextInterface, grantID string) error {
+	grant, err := c.getConsentGrant(ctx, grantID)
+	if err != nil {
+		return err
+	}
+	if grant == nil {
+		return fmt.Errorf("consent grant %s does not exist", grantID)
+	}
+
+	record, err := c.getRecord(ctx, grant.RecordID)
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		return fmt.Errorf("only the patient can revoke consent grant %s", grantID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != record.PatientID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, record.ID, "share")
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("only the patient can revoke consent grant %s", grantID)
+		}
+	}
+
+	grant.Revoked = true
+	if err := c.putConsentGrant(ctx, *grant); err != nil {
+		return err
+	}
+
+	// A revoked grant must not leave a usable re-encryption capsule behind.
+	if err := c.purgeReencryptionCapsule(ctx, grant.RecordID, grant.GranteeID); err != nil {
+		return err
+	}
+
+	return c.emitConsentEvent(ctx, "ConsentRevoked", *grant)
+}
+
+// ListActiveConsents returns the consent grants for recordID that are
+// neither revoked, expired, nor exhausted, as of the current transaction
+// timestamp. Only the record's patient or doctor may call this.
+func (c *EHRContract) ListActiveConsents(ctx contractapi.TransactionContextInterface, recordID string) ([]*ConsentGrant, error) {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.ID != record.PatientID && caller.ID != record.DoctorID {
+		return nil, fmt.Errorf("user %s does not have permission to list consents for record %s", caller.ID, recordID)
+	}
+
+	queryString := fmt.Sprintf(`{"selector":{"recordId":"%s","revoked":false,"expired":false}}`, recordID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []*ConsentGrant
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var grant ConsentGrant
+		if err := json.Unmarshal(queryResponse.Value, &grant); err != nil {
+			return nil, err
+		}
+		if grant.isActive(now) {
+			grants = append(grants, &grant)
+		}
+	}
+
+	return grants, nil
+}
+
+// isActive reports whether the grant is currently usable at the given time.
+func (g *ConsentGrant) isActive(now time.Time) bool {
+	if g.Revoked || g.Expired {
+		return false
+	}
+	if now.Before(g.NotBefore) || now.After(g.NotAfter) {
+		return false
+	}
+	if g.MaxUses > 0 && g.UsesRemaining <= 0 {
+		return false
+	}
+	return true
+}
+
+// allows reports whether the grant covers the given action.
+func (g *ConsentGrant) allows(action string) bool {
+	for _, allowed := range g.AllowedActions {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateConsent finds an active grant for (recordID, granteeID, action) at
+// the current tx timestamp, decrements its usage count atomically, and
+// persists the transition (including flipping it to expired once its window
+// has closed so future reads skip it without recomputing).
+func (c *EHRContract) evaluateConsent(ctx contractapi.TransactionContextInterface, recordID string, granteeID string, action string) (bool, error) {
+	// Re-encryption capsules share the recordId/granteeId/revoked fields, so
+	// only documents carrying allowedActions are treated as grants.
+	queryString := fmt.Sprintf(`{"selector":{"recordId":"%s","granteeId":"%s","revoked":false,"allowedActions":{"$exists":true}}}`, recordID, granteeID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// ChaincodeStub.SetEvent keeps only the last call per transaction, so
+	// grants flipped to expired during this scan are batched into a single
+	// ConsentExpired event at the end instead of emitting one per grant and
+	// silently losing all but the last.
+	var justExpired []ConsentGrant
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return false, err
+		}
+
+		var grant ConsentGrant
+		if err := json.Unmarshal(queryResponse.Value, &grant); err != nil {
+			return false, err
+		}
+
+		if !grant.Expired && now.After(grant.NotAfter) {
+			grant.Expired = true
+			if err := c.putConsentGrant(ctx, grant); err != nil {
+				return false, err
+			}
+			justExpired = append(justExpired, grant)
+			continue
+		}
+
+		if !grant.isActive(now) || !grant.allows(action) {
+			continue
+		}
+
+		if grant.MaxUses > 0 {
+			grant.UsesRemaining--
+			if err := c.putConsentGrant(ctx, grant); err != nil {
+				return false, err
+			}
+		}
+
+		if err := c.emitConsentExpiredEvent(ctx, justExpired); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := c.emitConsentExpiredEvent(ctx, justExpired); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// emitConsentExpiredEvent publishes a single ConsentExpired event covering
+// every grant evaluateConsent flipped to expired during its scan. It is a
+// no-op when grants is empty, since ChaincodeStub.SetEvent keeps only the
+// last call per transaction and calling it per-grant would silently drop
+// all but one expiry notification.
+func (c *EHRContract) emitConsentExpiredEvent(ctx contractapi.TransactionContextInterface, grants []ConsentGrant) error {
+	if len(grants) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(grants)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().SetEvent("ConsentExpired", payload)
+}
+
+func (c *EHRContract) putConsentGrant(ctx contractapi.TransactionContextInterface, grant ConsentGrant) error {
+	key, err := consentKey(ctx, grant.ID)
+	if err != nil {
+		return fmt.Errorf("failed to build consent key: %v", err)
+	}
+
+	grantJSON, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(key, grantJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+	return nil
+}
+
+func (c *EHRContract) getConsentGrant(ctx contractapi.TransactionContextInterface, grantID string) (*ConsentGrant, error) {
+	key, err := consentKey(ctx, grantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build consent key: %v", err)
+	}
+
+	grantJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if grantJSON == nil {
+		return nil, nil
+	}
+
+	var grant ConsentGrant
+	if err := json.Unmarshal(grantJSON, &grant); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// emitConsentEvent publishes a chaincode event so off-chain listeners can
+// notify patients of grant lifecycle changes.
+func (c *EHRContract) emitConsentEvent(ctx contractapi.TransactionContextInterface, eventName string, grant ConsentGrant) error {
+	payload, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().SetEvent(eventName, payload)
+}
@@ -21,15 +21,17 @@ type EHRContract struct {
 
 // EHRRecord represents an electronic health record
 type EHRRecord struct {
-	ID          string    `json:"id"`
-	PatientID   string    `json:"patientId"`
-	DoctorID    string    `json:"doctorId"`
-	RecordType  string    `json:"recordType"`
-	Data        string    `json:"data"`        // Encrypted health data
-	Hash        string    `json:"hash"`        // Data integrity hash
-	Timestamp   time.Time `json:"timestamp"`
-	Permissions []string  `json:"permissions"` // List of authorized user IDs
-	Status      string    `json:"status"`      // active, archived, deleted
+	ID          string      `json:"id"`
+	PatientID   string      `json:"patientId"`
+	DoctorID    string      `json:"doctorId"`
+	OrgID       string      `json:"orgId"` // Organization this record's role assignments are scoped under
+	RecordType  string      `json:"recordType"`
+	Data        string      `json:"data"`                 // Encrypted health data (inline; empty once migrated to ContentRef)
+	ContentRef  *ContentRef `json:"contentRef,omitempty"` // Off-chain payload location, when not stored inline
+	Hash        string      `json:"hash"`                 // Data integrity hash (CID when ContentRef is set)
+	Timestamp   time.Time   `json:"timestamp"`
+	Permissions []string    `json:"permissions"` // List of authorized user IDs
+	Status      string      `json:"status"`      // active, archived, deleted
 }
 
 // AccessLog represents an access log entry
@@ -43,8 +45,10 @@ type AccessLog struct {
 	Success   bool      `json:"success"`
 }
 
-// CreateEHRRecord creates a new EHR record on the blockchain
-func (c *EHRContract) CreateEHRRecord(ctx contractapi.TransactionContextInterface, id string, patientID string, doctorID string, recordType string, encryptedData string, dataHash string) error {
+// CreateEHRRecord creates a new EHR record on the blockchain. orgID scopes
+// the record to the organization that role assignments (AssignRole) must be
+// made under for checkAccountAccess to recognize them.
+func (c *EHRContract) CreateEHRRecord(ctx contractapi.TransactionContextInterface, id string, patientID string, doctorID string, orgID string, recordType string, encryptedData string, dataHash string) error {
 	// Check if record already exists
 	existing, err := ctx.GetStub().GetState(id)
 	if err != nil {
@@ -54,15 +58,35 @@ func (c *EHRContract) CreateEHRRecord(ctx contractapi.TransactionContextInterfac
 		return fmt.Errorf("record %s already exists", id)
 	}
 
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != doctorID {
+		allowed, err := c.hasAccessLevel(ctx, caller.ID, orgID, ContractCallAccess)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("user %s does not have permission to create a record in organization %s", caller.ID, orgID)
+		}
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Create new EHR record
 	record := EHRRecord{
 		ID:          id,
 		PatientID:   patientID,
 		DoctorID:    doctorID,
+		OrgID:       orgID,
 		RecordType:  recordType,
 		Data:        encryptedData,
 		Hash:        dataHash,
-		Timestamp:   time.Now(),
+		Timestamp:   now,
 		Permissions: []string{patientID, doctorID}, // Patient and doctor have access by default
 		Status:      "active",
 	}
@@ -79,7 +103,7 @@ func (c *EHRContract) CreateEHRRecord(ctx contractapi.TransactionContextInterfac
 	}
 
 	// Log the creation
-	err = c.logAccess(ctx, id, doctorID, "create", "", true)
+	err = c.logAccess(ctx, id, "create", true)
 	if err != nil {
 		return fmt.Errorf("failed to log access: %v", err)
 	}
@@ -87,15 +111,22 @@ func (c *EHRContract) CreateEHRRecord(ctx contractapi.TransactionContextInterfac
 	return nil
 }
 
-// ReadEHRRecord reads an EHR record from the blockchain
-func (c *EHRContract) ReadEHRRecord(ctx contractapi.TransactionContextInterface, id string, userID string, ipAddress string) (*EHRRecord, error) {
+// ReadEHRRecord reads an EHR record from the blockchain. The caller's
+// identity is taken from their client certificate, not a supplied argument,
+// so a transaction cannot read on behalf of an impersonated user.
+func (c *EHRContract) ReadEHRRecord(ctx contractapi.TransactionContextInterface, id string) (*EHRRecord, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	recordJSON, err := ctx.GetStub().GetState(id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state: %v", err)
 	}
 	if recordJSON == nil {
 		// Log failed access attempt
-		c.logAccess(ctx, id, userID, "read", ipAddress, false)
+		c.logAccess(ctx, id, "read", false)
 		return nil, fmt.Errorf("record %s does not exist", id)
 	}
 
@@ -105,15 +136,30 @@ func (c *EHRContract) ReadEHRRecord(ctx contractapi.TransactionContextInterface,
 		return nil, err
 	}
 
-	// Check permissions
-	if !c.hasPermission(userID, record.Permissions) {
-		// Log unauthorized access attempt
-		c.logAccess(ctx, id, userID, "read", ipAddress, false)
-		return nil, fmt.Errorf("user %s does not have permission to read record %s", userID, id)
+	// Check permissions: the legacy permission list first, then any
+	// active, purpose-scoped consent grant the patient has issued, then the
+	// role registry (covers doctors/nurses/researchers/auditors assigned via
+	// AssignRole rather than added to Permissions or granted consent).
+	if !c.hasPermission(caller.ID, record.Permissions) {
+		granted, err := c.evaluateConsent(ctx, id, caller.ID, "read")
+		if err != nil {
+			return nil, err
+		}
+		if !granted {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, id, "read")
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				// Log unauthorized access attempt
+				c.logAccess(ctx, id, "read", false)
+				return nil, fmt.Errorf("user %s does not have permission to read record %s", caller.ID, id)
+			}
+		}
 	}
 
 	// Log successful access
-	err = c.logAccess(ctx, id, userID, "read", ipAddress, true)
+	err = c.logAccess(ctx, id, "read", true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to log access: %v", err)
 	}
@@ -122,22 +168,46 @@ func (c *EHRContract) ReadEHRRecord(ctx contractapi.TransactionContextInterface,
 }
 
 // UpdateEHRRecord updates an existing EHR record
-func (c *EHRContract) UpdateEHRRecord(ctx contractapi.TransactionContextInterface, id string, userID string, encryptedData string, dataHash string, ipAddress string) error {
-	record, err := c.ReadEHRRecord(ctx, id, userID, ipAddress)
+func (c *EHRContract) UpdateEHRRecord(ctx contractapi.TransactionContextInterface, id string, encryptedData string, dataHash string) error {
+	record, err := c.ReadEHRRecord(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	// Check if user has write permission (only doctor and patient can update)
-	if userID != record.DoctorID && userID != record.PatientID {
-		c.logAccess(ctx, id, userID, "write", ipAddress, false)
-		return fmt.Errorf("user %s does not have permission to update record %s", userID, id)
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Check if user has write permission: the doctor/patient the record was
+	// created with, a grantee whose ConsentGrant allows "write", or anyone
+	// the role registry grants write access to.
+	if caller.ID != record.DoctorID && caller.ID != record.PatientID {
+		granted, err := c.evaluateConsent(ctx, id, caller.ID, "write")
+		if err != nil {
+			return err
+		}
+		if !granted {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, id, "write")
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				c.logAccess(ctx, id, "write", false)
+				return fmt.Errorf("user %s does not have permission to update record %s", caller.ID, id)
+			}
+		}
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
 	}
 
 	// Update record
 	record.Data = encryptedData
 	record.Hash = dataHash
-	record.Timestamp = time.Now()
+	record.Timestamp = now
 
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
@@ -150,7 +220,7 @@ func (c *EHRContract) UpdateEHRRecord(ctx contractapi.TransactionContextInterfac
 	}
 
 	// Log the update
-	err = c.logAccess(ctx, id, userID, "write", ipAddress, true)
+	err = c.logAccess(ctx, id, "write", true)
 	if err != nil {
 		return fmt.Errorf("failed to log access: %v", err)
 	}
@@ -158,17 +228,46 @@ func (c *EHRContract) UpdateEHRRecord(ctx contractapi.TransactionContextInterfac
 	return nil
 }
 
-// ShareEHRRecord grants access permission to another user
-func (c *EHRContract) ShareEHRRecord(ctx contractapi.TransactionContextInterface, recordID string, ownerID string, targetUserID string, ipAddress string) error {
-	record, err := c.ReadEHRRecord(ctx, recordID, ownerID, ipAddress)
+// shareGrantID derives the consent grant ID ShareEHRRecord/RevokeAccess use,
+// so that the share grant for a grantee is addressable without the caller
+// having to track a generated ID. The ID is fixed per (record, grantee), so
+// a second share to the same grantee fails while the earlier grant exists,
+// even once it has been revoked.
+func shareGrantID(recordID string, targetUserID string) string {
+	return fmt.Sprintf("share_%s_%s", recordID, targetUserID)
+}
+
+// ShareEHRRecord grants access to another user by issuing an open-ended
+// "treatment"-purpose ConsentGrant, rather than permanently appending to
+// record.Permissions.
+func (c *EHRContract) ShareEHRRecord(ctx contractapi.TransactionContextInterface, recordID string, targetUserID string) error {
+	record, err := c.ReadEHRRecord(ctx, recordID)
 	if err != nil {
 		return err
 	}
 
-	// Only patient can share their records
-	if ownerID != record.PatientID {
-		c.logAccess(ctx, recordID, ownerID, "share", ipAddress, false)
-		return fmt.Errorf("only the patient can share their records")
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only the patient, a grantee whose ConsentGrant allows "share", or
+	// someone the role registry grants sharing access to, can share records.
+	if caller.ID != record.PatientID {
+		granted, err := c.evaluateConsent(ctx, recordID, caller.ID, "share")
+		if err != nil {
+			return err
+		}
+		if !granted {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "share")
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				c.logAccess(ctx, recordID, "share", false)
+				return fmt.Errorf("only the patient can share their records")
+			}
+		}
 	}
 
 	// Check if user already has permission
@@ -176,21 +275,20 @@ func (c *EHRContract) ShareEHRRecord(ctx contractapi.TransactionContextInterface
 		return fmt.Errorf("user %s already has access to record %s", targetUserID, recordID)
 	}
 
-	// Add permission
-	record.Permissions = append(record.Permissions, targetUserID)
-
-	recordJSON, err := json.Marshal(record)
+	now, err := txTimestamp(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(recordID, recordJSON)
+	err = c.GrantConsent(ctx, shareGrantID(recordID, targetUserID), recordID, targetUserID,
+		"treatment", []string{"read", "write", "share"}, now, now.AddDate(100, 0, 0), 0)
 	if err != nil {
-		return fmt.Errorf("failed to put to world state: %v", err)
+		c.logAccess(ctx, recordID, "share", false)
+		return err
 	}
 
 	// Log the sharing
-	err = c.logAccess(ctx, recordID, ownerID, "share", ipAddress, true)
+	err = c.logAccess(ctx, recordID, "share", true)
 	if err != nil {
 		return fmt.Errorf("failed to log access: %v", err)
 	}
@@ -198,16 +296,35 @@ func (c *EHRContract) ShareEHRRecord(ctx contractapi.TransactionContextInterface
 	return nil
 }
 
-// RevokeAccess removes access permission from a user
-func (c *EHRContract) RevokeAccess(ctx contractapi.TransactionContextInterface, recordID string, ownerID string, targetUserID string, ipAddress string) error {
-	record, err := c.ReadEHRRecord(ctx, recordID, ownerID, ipAddress)
+// RevokeAccess revokes the ConsentGrant ShareEHRRecord issued to targetUserID.
+func (c *EHRContract) RevokeAccess(ctx contractapi.TransactionContextInterface, recordID string, targetUserID string) error {
+	record, err := c.ReadEHRRecord(ctx, recordID)
 	if err != nil {
 		return err
 	}
 
-	// Only patient can revoke access (except for doctor)
-	if ownerID != record.PatientID {
-		return fmt.Errorf("only the patient can revoke access to their records")
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only the patient, a grantee whose ConsentGrant allows "share", or
+	// someone the role registry grants sharing access to, can revoke access
+	// (except for doctor, see below).
+	if caller.ID != record.PatientID {
+		granted, err := c.evaluateConsent(ctx, recordID, caller.ID, "share")
+		if err != nil {
+			return err
+		}
+		if !granted {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "share")
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return fmt.Errorf("only the patient can revoke access to their records")
+			}
+		}
 	}
 
 	// Cannot revoke doctor's access
@@ -215,28 +332,13 @@ func (c *EHRContract) RevokeAccess(ctx contractapi.TransactionContextInterface,
 		return fmt.Errorf("cannot revoke doctor's access to patient records")
 	}
 
-	// Remove permission
-	newPermissions := []string{}
-	for _, userID := range record.Permissions {
-		if userID != targetUserID {
-			newPermissions = append(newPermissions, userID)
-		}
-	}
-
-	record.Permissions = newPermissions
-
-	recordJSON, err := json.Marshal(record)
+	err = c.RevokeConsent(ctx, shareGrantID(recordID, targetUserID))
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(recordID, recordJSON)
-	if err != nil {
-		return fmt.Errorf("failed to put to world state: %v", err)
-	}
-
 	// Log the revocation
-	err = c.logAccess(ctx, recordID, ownerID, "revoke", ipAddress, true)
+	err = c.logAccess(ctx, recordID, "revoke", true)
 	if err != nil {
 		return fmt.Errorf("failed to log access: %v", err)
 	}
@@ -245,16 +347,28 @@ func (c *EHRContract) RevokeAccess(ctx contractapi.TransactionContextInterface,
 }
 
 // GetAccessLogs retrieves access logs for a specific record
-func (c *EHRContract) GetAccessLogs(ctx contractapi.TransactionContextInterface, recordID string, userID string) ([]*AccessLog, error) {
+func (c *EHRContract) GetAccessLogs(ctx contractapi.TransactionContextInterface, recordID string) ([]*AccessLog, error) {
 	// Check if user has permission to view logs
-	record, err := c.ReadEHRRecord(ctx, recordID, userID, "")
+	record, err := c.ReadEHRRecord(ctx, recordID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Only patient and doctor can view access logs
-	if userID != record.PatientID && userID != record.DoctorID {
-		return nil, fmt.Errorf("user %s does not have permission to view access logs", userID)
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patient, doctor, or anyone the role registry grants read access to
+	// (e.g. an Auditor) can view access logs.
+	if caller.ID != record.PatientID && caller.ID != record.DoctorID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "read")
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, fmt.Errorf("user %s does not have permission to view access logs", caller.ID)
+		}
 	}
 
 	// Query access logs
@@ -293,16 +407,38 @@ func (c *EHRContract) hasPermission(userID string, permissions []string) bool {
 	return false
 }
 
-// Helper function to log access attempts
-func (c *EHRContract) logAccess(ctx contractapi.TransactionContextInterface, recordID string, userID string, action string, ipAddress string, success bool) error {
-	logID := fmt.Sprintf("log_%s_%s_%d", recordID, userID, time.Now().UnixNano())
-	
+// Helper function to log access attempts. The actor is always the
+// transaction submitter's own identity (never a caller-supplied userID), the
+// timestamp comes from the transaction itself so every endorsing peer
+// agrees, and the log ID is derived from the transaction ID so it is
+// collision-free without relying on wall-clock precision. ipAddress is
+// read from the transient map rather than a public argument; it is stored
+// in the AccessLog entry in world state, so anyone who can read that key
+// or query the access logs can see it.
+func (c *EHRContract) logAccess(ctx contractapi.TransactionContextInterface, recordID string, action string, success bool) error {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	ipAddress, err := getTransientIPAddress(ctx)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	logID := fmt.Sprintf("log_%s", ctx.GetStub().GetTxID())
+
 	accessLog := AccessLog{
 		ID:        logID,
 		RecordID:  recordID,
-		UserID:    userID,
+		UserID:    caller.ID,
 		Action:    action,
-		Timestamp: time.Now(),
+		Timestamp: now,
 		IPAddress: ipAddress,
 		Success:   success,
 	}
@@ -316,11 +452,10 @@ func (c *EHRContract) logAccess(ctx contractapi.TransactionContextInterface, rec
 }
 
 // GetAllRecordsForPatient retrieves all records for a specific patient
-func (c *EHRContract) GetAllRecordsForPatient(ctx contractapi.TransactionContextInterface, patientID string, userID string) ([]*EHRRecord, error) {
-	// Check if user has permission (patient themselves or their doctor)
-	if userID != patientID {
-		// TODO: Add logic to check if userID is one of patient's doctors
-		return nil, fmt.Errorf("user %s does not have permission to view patient records", userID)
+func (c *EHRContract) GetAllRecordsForPatient(ctx contractapi.TransactionContextInterface, patientID string) ([]*EHRRecord, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s","status":"active"}}`, patientID)
@@ -342,6 +477,20 @@ func (c *EHRContract) GetAllRecordsForPatient(ctx contractapi.TransactionContext
 		if err != nil {
 			return nil, err
 		}
+
+		// The patient themselves, or anyone the role registry recognizes
+		// as one of the patient's doctors/nurses/researchers/auditors,
+		// may view the record.
+		if caller.ID != patientID {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, record.ID, "read")
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				continue
+			}
+		}
+
 		records = append(records, &record)
 	}
 
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// callerIdentity is the submitting client's identity as derived from its
+// X.509 certificate via the client identity library, never from a
+// caller-supplied argument that any peer could forge.
+type callerIdentity struct {
+	ID    string // cid.GetID(): a stable, unique identifier for the identity
+	MSPID string
+	Role  string // the "hf.EHR.Role" X.509 attribute, if the cert carries one
+}
+
+// getCallerIdentity resolves the transaction submitter's identity so that
+// functions no longer have to trust a userID argument the caller could set
+// to anyone they like.
+func getCallerIdentity(ctx contractapi.TransactionContextInterface) (*callerIdentity, error) {
+	clientID, err := cid.New(ctx.GetStub())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client identity: %v", err)
+	}
+
+	id, err := clientID.GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ID: %v", err)
+	}
+
+	mspID, err := clientID.GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+
+	role, _, err := clientID.GetAttributeValue("hf.EHR.Role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hf.EHR.Role attribute: %v", err)
+	}
+
+	return &callerIdentity{ID: id, MSPID: mspID, Role: role}, nil
+}
+
+// getTransientIPAddress reads the optional "ipAddress" transient field used
+// for audit logging. Transient data is not part of the committed
+// transaction the way a public argument is; logAccess does, however, write
+// the value into the AccessLog entry it stores in world state.
+func getTransientIPAddress(ctx contractapi.TransactionContextInterface) (string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to read transient data: %v", err)
+	}
+	return string(transient["ipAddress"]), nil
+}
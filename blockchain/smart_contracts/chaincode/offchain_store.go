@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+// ContentRef points at an encrypted payload held off-chain (e.g. in IPFS)
+// instead of embedding it inline in EHRRecord.Data. It follows the same
+// multihash/multicodec addressing ENS contenthash resolvers use, so the CID
+// is self-describing about which hash function and content format produced
+// it.
+type ContentRef struct {
+	CID        string `json:"cid"`        // multibase-encoded CID (multihash + multicodec)
+	Size       int64  `json:"size"`       // payload size in bytes
+	MIMEType   string `json:"mimeType"`   // e.g. "application/dicom"
+	Algorithm  string `json:"algorithm"`  // encryption algorithm identifier, e.g. "AES-256-GCM"
+	StoreAlias string `json:"storeAlias"` // which OffChainStore backend this CID lives in
+}
+
+// rawBinaryMulticodec is the multicodec code for "raw binary" content,
+// matching how ENS contenthash encodes opaque IPFS payloads.
+const rawBinaryMulticodec = 0x55
+
+// OffChainStore is the pluggable interface the chaincode uses to persist
+// and fetch encrypted payloads that are too large to keep on-chain. The
+// chaincode itself never holds more than the ContentRef integrity metadata.
+type OffChainStore interface {
+	// Put stores the encrypted payload and returns its ContentRef.
+	Put(encryptedData []byte, mimeType string, algorithm string) (ContentRef, error)
+	// Get retrieves the encrypted payload for a previously stored ContentRef.
+	Get(ref ContentRef) ([]byte, error)
+}
+
+// IPFSStore is an OffChainStore backed by an IPFS node reachable over its
+// HTTP API. It is deliberately minimal: chaincode execution must stay
+// deterministic across endorsing peers, so writes are expected to happen
+// off-chain (by the client) and only the resulting ContentRef is submitted
+// to CreateEHRRecordWithContentRef; Put/Get here exist so the same
+// interface can be exercised from client-side tooling and tests.
+type IPFSStore struct {
+	Alias string
+}
+
+// NewIPFSStore constructs an IPFSStore identified by alias, used to
+// populate ContentRef.StoreAlias so a client fetching the payload knows
+// which backend holds it.
+func NewIPFSStore(alias string) *IPFSStore {
+	return &IPFSStore{Alias: alias}
+}
+
+// Put computes the CID for encryptedData and returns its ContentRef. The
+// actual upload to IPFS is performed by the caller; this only derives the
+// addressing metadata so the chaincode can later verify integrity.
+func (s *IPFSStore) Put(encryptedData []byte, mimeType string, algorithm string) (ContentRef, error) {
+	cid, err := computeCID(encryptedData)
+	if err != nil {
+		return ContentRef{}, err
+	}
+	return ContentRef{
+		CID:        cid,
+		Size:       int64(len(encryptedData)),
+		MIMEType:   mimeType,
+		Algorithm:  algorithm,
+		StoreAlias: s.Alias,
+	}, nil
+}
+
+// Get is not implemented at the chaincode layer: fetching the payload
+// itself happens client-side against IPFS directly, using ref.CID. The
+// chaincode only ever verifies the hash the client already retrieved.
+func (s *IPFSStore) Get(ref ContentRef) ([]byte, error) {
+	return nil, fmt.Errorf("IPFSStore.Get must be performed off-chain; chaincode only verifies %s", ref.CID)
+}
+
+// computeCID derives a multibase-encoded CID (sha2-256 multihash wrapping a
+// raw-binary multicodec) for data.
+func computeCID(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	mh, err := multihash.Encode(sum[:], multihash.SHA2_256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute multihash: %v", err)
+	}
+
+	// CIDv1 prefix: version(1) + multicodec(raw binary) + multihash.
+	cidBytes := append([]byte{0x01, rawBinaryMulticodec}, mh...)
+
+	cid, err := multibase.Encode(multibase.Base32, cidBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to multibase-encode CID: %v", err)
+	}
+	return cid, nil
+}
+
+// verifyContentRef recomputes the multihash of data and checks it matches
+// both ref.CID and the record's integrity hash.
+func verifyContentRef(ref ContentRef, hash string, data []byte) error {
+	recomputed, err := computeCID(data)
+	if err != nil {
+		return err
+	}
+	if recomputed != ref.CID {
+		return fmt.Errorf("content hash mismatch: expected %s, computed %s", ref.CID, recomputed)
+	}
+	if hash != "" && hash != ref.CID {
+		return fmt.Errorf("record hash %s does not match content ref %s", hash, ref.CID)
+	}
+	return nil
+}
+
+// CreateEHRRecordWithContentRef creates a new EHR record whose payload
+// lives off-chain, storing only the ContentRef integrity metadata on-chain.
+// orgID scopes the record to the organization that role assignments
+// (AssignRole) must be made under for checkAccountAccess to recognize them.
+func (c *EHRContract) CreateEHRRecordWithContentRef(ctx contractapi.TransactionContextInterface, id string, patientID string, doctorID string, orgID string, recordType string, ref ContentRef) error {
+	existing, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("record %s already exists", id)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != doctorID {
+		allowed, err := c.hasAccessLevel(ctx, caller.ID, orgID, ContractCallAccess)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("user %s does not have permission to create a record in organization %s", caller.ID, orgID)
+		}
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	record := EHRRecord{
+		ID:          id,
+		PatientID:   patientID,
+		DoctorID:    doctorID,
+		OrgID:       orgID,
+		RecordType:  recordType,
+		Hash:        ref.CID,
+		ContentRef:  &ref,
+		Timestamp:   now,
+		Permissions: []string{patientID, doctorID},
+		Status:      "active",
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(id, recordJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return c.logAccess(ctx, id, "create", true)
+}
+
+// VerifyContentRef re-derives the multihash for a payload the caller has
+// already fetched from off-chain storage (e.g. IPFS) and checks it matches
+// the record's stored ContentRef and integrity hash. Chaincode execution
+// cannot dial IPFS directly without breaking determinism across endorsing
+// peers, so the payload bytes are supplied by the caller as the payload
+// argument, fetched by the caller before this is invoked. Gated by the same
+// read access ReadEHRRecord requires, since a successful verification
+// confirms facts about the record's contents to the caller.
+func (c *EHRContract) VerifyContentRef(ctx contractapi.TransactionContextInterface, recordID string, payload []byte) error {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("record %s does not exist", recordID)
+	}
+	if record.ContentRef == nil {
+		return fmt.Errorf("record %s does not use off-chain content storage", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.hasPermission(caller.ID, record.Permissions) {
+		granted, err := c.evaluateConsent(ctx, recordID, caller.ID, "read")
+		if err != nil {
+			return err
+		}
+		if !granted {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "read")
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return fmt.Errorf("user %s does not have permission to read record %s", caller.ID, recordID)
+			}
+		}
+	}
+
+	return verifyContentRef(*record.ContentRef, record.Hash, payload)
+}
+
+// MigrateToContentRef moves an existing inline record's payload to off-chain
+// storage: the caller supplies the ContentRef produced by store.Put(record.Data),
+// and this clears record.Data once the CID has been verified against the
+// record's existing integrity hash.
+func (c *EHRContract) MigrateToContentRef(ctx contractapi.TransactionContextInterface, recordID string, ref ContentRef) error {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != record.PatientID && caller.ID != record.DoctorID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "write")
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("user %s does not have permission to migrate record %s", caller.ID, recordID)
+		}
+	}
+	if record.ContentRef != nil {
+		return fmt.Errorf("record %s has already been migrated to off-chain storage", recordID)
+	}
+	if record.Data == "" {
+		return fmt.Errorf("record %s has no inline data to migrate", recordID)
+	}
+
+	if err := verifyContentRef(ref, record.Hash, []byte(record.Data)); err != nil {
+		return err
+	}
+
+	record.ContentRef = &ref
+	record.Hash = ref.CID
+	record.Data = ""
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(recordID, recordJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return c.logAccess(ctx, recordID, "migrate", true)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PublicKey is a user's registered proxy re-encryption public key. The
+// scheme identifier lets the chaincode accept more than one PRE curve/scheme
+// without client code having to special-case it.
+type PublicKey struct {
+	UserID string `json:"userId"`
+	Key    string `json:"key"`    // base64/PEM-encoded public key material
+	Scheme string `json:"scheme"` // e.g. "umbral", "bbs98"
+}
+
+// ReencryptionCapsule holds the re-encryption key that lets granteeID
+// decrypt recordID's payload locally,
+// without the patient ever handing over their private key or the chaincode
+// ever touching the plaintext.
+type ReencryptionCapsule struct {
+	RecordID  string `json:"recordId"`
+	GranteeID string `json:"granteeId"`
+	OwnerID   string `json:"ownerId"`
+	ReKey     string `json:"reKey"`  // rk_{owner->grantee}, computed off-chain by the patient
+	Scheme    string `json:"scheme"`
+	Revoked   bool   `json:"revoked"`
+}
+
+func publicKeyKey(ctx contractapi.TransactionContextInterface, userID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("pubkey", []string{userID})
+}
+
+func capsuleKey(ctx contractapi.TransactionContextInterface, recordID string, granteeID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("capsule", []string{recordID, granteeID})
+}
+
+// RegisterPublicKey registers or rotates a user's proxy re-encryption public
+// key, which other patients look up off-chain before computing a rekey for
+// them. Only the user themselves, as identified by their client certificate,
+// may register their own key.
+func (c *EHRContract) RegisterPublicKey(ctx contractapi.TransactionContextInterface, userID string, pubkey string, scheme string) error {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != userID {
+		return fmt.Errorf("user %s cannot register a public key on behalf of %s", caller.ID, userID)
+	}
+
+	key, err := publicKeyKey(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to build public key key: %v", err)
+	}
+
+	record := PublicKey{UserID: userID, Key: pubkey, Scheme: scheme}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+	return nil
+}
+
+// GetPublicKey returns userID's registered proxy re-encryption public key,
+// so a patient's client can fetch a grantee's key before computing a rekey
+// for them off-chain.
+func (c *EHRContract) GetPublicKey(ctx contractapi.TransactionContextInterface, userID string) (*PublicKey, error) {
+	key, err := publicKeyKey(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build public key key: %v", err)
+	}
+
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, fmt.Errorf("no public key registered for user %s", userID)
+	}
+
+	var record PublicKey
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// SubmitReencryptionKey stores the re-encryption key the patient computed
+// off-chain (rk_{owner->grantee}), tying its lifecycle to the consent grant
+// that authorized sharing recordID with granteeID. Only the record's
+// patient, or someone the role registry grants sharing access to, may
+// submit it.
+func (c *EHRContract) SubmitReencryptionKey(ctx contractapi.TransactionContextInterface, recordID string, granteeID string, rekey string, scheme string) error {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if caller.ID != record.PatientID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "share")
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("only the patient can submit a re-encryption key for record %s", recordID)
+		}
+	}
+
+	grant, err := c.getConsentGrant(ctx, shareGrantID(recordID, granteeID))
+	if err != nil {
+		return err
+	}
+	if grant == nil || grant.Revoked {
+		return fmt.Errorf("grantee %s does not have an active consent grant for record %s", granteeID, recordID)
+	}
+
+	key, err := capsuleKey(ctx, recordID, granteeID)
+	if err != nil {
+		return fmt.Errorf("failed to build capsule key: %v", err)
+	}
+
+	capsule := ReencryptionCapsule{
+		RecordID:  recordID,
+		GranteeID: granteeID,
+		OwnerID:   caller.ID,
+		ReKey:     rekey,
+		Scheme:    scheme,
+	}
+	capsuleJSON, err := json.Marshal(capsule)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(key, capsuleJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+	return nil
+}
+
+// FetchReencryptedCapsule returns the stored re-encryption capsule so the
+// caller can decrypt recordID's payload locally. Only the grantee the
+// capsule was issued to, as identified by their client certificate, may
+// fetch it. The fetch itself is logged through logAccess with action
+// "reencrypt" since it is, in effect, a read of the patient's sharing
+// intent.
+func (c *EHRContract) FetchReencryptedCapsule(ctx contractapi.TransactionContextInterface, recordID string) (*ReencryptionCapsule, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := capsuleKey(ctx, recordID, caller.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build capsule key: %v", err)
+	}
+
+	capsuleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if capsuleJSON == nil {
+		c.logAccess(ctx, recordID, "reencrypt", false)
+		return nil, fmt.Errorf("no re-encryption capsule for grantee %s on record %s", caller.ID, recordID)
+	}
+
+	var capsule ReencryptionCapsule
+	if err := json.Unmarshal(capsuleJSON, &capsule); err != nil {
+		return nil, err
+	}
+	if capsule.Revoked {
+		c.logAccess(ctx, recordID, "reencrypt", false)
+		return nil, fmt.Errorf("re-encryption capsule for grantee %s on record %s has been revoked", caller.ID, recordID)
+	}
+
+	if err := c.logAccess(ctx, recordID, "reencrypt", true); err != nil {
+		return nil, fmt.Errorf("failed to log access: %v", err)
+	}
+
+	return &capsule, nil
+}
+
+// purgeReencryptionCapsule marks the capsule for (recordID, granteeID) as
+// revoked, called when the underlying consent grant is revoked so a patient
+// cutting off access cannot have it bypassed via a stale capsule.
+func (c *EHRContract) purgeReencryptionCapsule(ctx contractapi.TransactionContextInterface, recordID string, granteeID string) error {
+	key, err := capsuleKey(ctx, recordID, granteeID)
+	if err != nil {
+		return fmt.Errorf("failed to build capsule key: %v", err)
+	}
+
+	capsuleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if capsuleJSON == nil {
+		return nil
+	}
+
+	var capsule ReencryptionCapsule
+	if err := json.Unmarshal(capsuleJSON, &capsule); err != nil {
+		return err
+	}
+	capsule.Revoked = true
+
+	capsuleJSON, err = json.Marshal(capsule)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, capsuleJSON)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// AccessLogPage is a single page of access log results, along with the
+// CouchDB bookmark needed to fetch the next one.
+type AccessLogPage struct {
+	Items        []*AccessLog `json:"items"`
+	NextBookmark string       `json:"nextBookmark"`
+	FetchedCount int32        `json:"fetchedCount"`
+}
+
+// RecordPage is a single page of EHR record results, along with the
+// CouchDB bookmark needed to fetch the next one.
+type RecordPage struct {
+	Items        []*EHRRecord `json:"items"`
+	NextBookmark string       `json:"nextBookmark"`
+	FetchedCount int32        `json:"fetchedCount"`
+}
+
+// GetAccessLogsPage retrieves a single page of access logs for recordID,
+// using the indexRecordId CouchDB index. bookmark should be empty for the
+// first page and the previous page's NextBookmark thereafter.
+func (c *EHRContract) GetAccessLogsPage(ctx contractapi.TransactionContextInterface, recordID string, pageSize int32, bookmark string) (*AccessLogPage, error) {
+	record, err := c.ReadEHRRecord(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patient, doctor, or anyone the role registry grants read access to
+	// (e.g. an Auditor) can view access logs.
+	if caller.ID != record.PatientID && caller.ID != record.DoctorID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "read")
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, fmt.Errorf("user %s does not have permission to view access logs", caller.ID)
+		}
+	}
+
+	// Consent grants and re-encryption capsules also carry recordId, so only
+	// documents with an action field are taken as access logs.
+	queryString := fmt.Sprintf(`{"selector":{"recordId":"%s","action":{"$exists":true}}}`, recordID)
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := &AccessLogPage{
+		NextBookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var log AccessLog
+		if err := json.Unmarshal(queryResponse.Value, &log); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, &log)
+	}
+
+	return page, nil
+}
+
+// GetAccessLogsByTimeRange returns access logs for recordID whose
+// timestamp falls within [from, to], using the indexTimestamp CouchDB
+// index. Intended for HIPAA audit exports, which pull a bounded window
+// rather than the whole history.
+func (c *EHRContract) GetAccessLogsByTimeRange(ctx contractapi.TransactionContextInterface, recordID string, from string, to string, pageSize int32, bookmark string) (*AccessLogPage, error) {
+	record, err := c.ReadEHRRecord(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.ID != record.PatientID && caller.ID != record.DoctorID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "read")
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, fmt.Errorf("user %s does not have permission to view access logs", caller.ID)
+		}
+	}
+
+	queryString := fmt.Sprintf(`{"selector":{"recordId":"%s","timestamp":{"$gte":"%s","$lte":"%s"}}}`, recordID, from, to)
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := &AccessLogPage{
+		NextBookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var log AccessLog
+		if err := json.Unmarshal(queryResponse.Value, &log); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, &log)
+	}
+
+	return page, nil
+}
+
+// GetRecordsForPatientPage retrieves a single page of active records for
+// patientID, using the indexPatientIdStatus CouchDB index. bookmark should
+// be empty for the first page and the previous page's NextBookmark
+// thereafter.
+func (c *EHRContract) GetRecordsForPatientPage(ctx contractapi.TransactionContextInterface, patientID string, pageSize int32, bookmark string) (*RecordPage, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s","status":"active"}}`, patientID)
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := &RecordPage{
+		NextBookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var record EHRRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, err
+		}
+
+		if caller.ID != patientID {
+			allowed, err := c.checkAccountAccess(ctx, caller.ID, record.ID, "read")
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				continue
+			}
+		}
+
+		page.Items = append(page.Items, &record)
+	}
+
+	return page, nil
+}
+
+// GetRecordHistory returns the immutable version chain for recordID,
+// including superseded revisions, using GetHistoryForKey. Key deletions,
+// which carry no record value, are skipped. Only the
+// patient, their doctor, or someone the role registry grants read access to
+// (e.g. an Auditor) may pull the full history.
+func (c *EHRContract) GetRecordHistory(ctx contractapi.TransactionContextInterface, recordID string) ([]*EHRRecord, error) {
+	current, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.ID != current.PatientID && caller.ID != current.DoctorID {
+		allowed, err := c.checkAccountAccess(ctx, caller.ID, recordID, "read")
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, fmt.Errorf("user %s does not have permission to view the history of record %s", caller.ID, recordID)
+		}
+	}
+
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(recordID)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var history []*EHRRecord
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if modification.IsDelete {
+			continue
+		}
+
+		var record EHRRecord
+		if err := json.Unmarshal(modification.Value, &record); err != nil {
+			return nil, err
+		}
+		history = append(history, &record)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// AccessLevel mirrors the Quorum-style permissioning levels: how much an
+// account is allowed to do within an organization, independent of its
+// clinical role.
+type AccessLevel string
+
+const (
+	// ReadOnlyAccess can read records but cannot submit transactions.
+	ReadOnlyAccess AccessLevel = "ReadOnly"
+	// ContractCallAccess can read records and create new ones in the
+	// organization, but cannot write or share existing records or manage
+	// organizations or roles.
+	ContractCallAccess AccessLevel = "ContractCall"
+	// TransactAccess can submit state-changing transactions, including
+	// record writes and shares.
+	TransactAccess AccessLevel = "Transact"
+	// FullAccess can additionally manage organizations and roles.
+	FullAccess AccessLevel = "FullAccess"
+)
+
+// Role identifies the clinical or administrative capacity a user holds
+// within an organization.
+type Role string
+
+const (
+	RolePatient          Role = "Patient"
+	RolePrimaryDoctor    Role = "PrimaryDoctor"
+	RoleConsultingDoctor Role = "ConsultingDoctor"
+	RoleNurse            Role = "Nurse"
+	RoleResearcher       Role = "Researcher"
+	RoleAdmin            Role = "Admin"
+	RoleAuditor          Role = "Auditor"
+)
+
+// Organization represents a hospital, clinic, or other entity that
+// participates in the network and under which roles are scoped.
+type Organization struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	MSPID     string `json:"mspId"`
+	Active    bool   `json:"active"`
+	CreatedBy string `json:"createdBy"`
+}
+
+// AccountAccess binds a user to a role and an access level within an
+// organization, optionally scoped to a single record (e.g. a consulting
+// doctor brought in for one patient rather than the whole org).
+type AccountAccess struct {
+	UserID   string      `json:"userId"`
+	OrgID    string      `json:"orgId"`
+	RecordID string      `json:"recordId,omitempty"` // empty means org-wide
+	Role     Role        `json:"role"`
+	Level    AccessLevel `json:"level"`
+	Revoked  bool        `json:"revoked"`
+}
+
+// orgKey returns the world-state key for an organization.
+func orgKey(ctx contractapi.TransactionContextInterface, orgID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("org", []string{orgID})
+}
+
+// roleKey returns the world-state key for a user's role assignment within
+// an organization, optionally scoped to a specific record.
+func roleKey(ctx contractapi.TransactionContextInterface, userID string, orgID string, recordID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("role", []string{orgID, userID, recordID})
+}
+
+// RegisterOrganization registers a new organization that roles can be
+// scoped to. Any caller may register an organization that does not exist
+// yet; no existing role or access level is checked. The caller becomes the
+// new organization's FullAccess Admin.
+func (c *EHRContract) RegisterOrganization(ctx contractapi.TransactionContextInterface, orgID string, name string, mspID string) error {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, err := orgKey(ctx, orgID)
+	if err != nil {
+		return fmt.Errorf("failed to build organization key: %v", err)
+	}
+
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("organization %s already exists", orgID)
+	}
+
+	org := Organization{
+		ID:        orgID,
+		Name:      name,
+		MSPID:     mspID,
+		Active:    true,
+		CreatedBy: caller.ID,
+	}
+
+	orgJSON, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(key, orgJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// The organization's creator is granted FullAccess as an Admin so
+	// they can bootstrap further role assignments.
+	return c.putRoleAssignment(ctx, AccountAccess{
+		UserID: caller.ID,
+		OrgID:  orgID,
+		Role:   RoleAdmin,
+		Level:  FullAccess,
+	})
+}
+
+// AssignRole grants userID a role and access level within orgID, optionally
+// scoped to a single recordID. Only a FullAccess account within that
+// organization may assign roles.
+func (c *EHRContract) AssignRole(ctx contractapi.TransactionContextInterface, userID string, orgID string, role string, level string, recordID string) error {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	granted, err := c.hasAccessLevel(ctx, caller.ID, orgID, FullAccess)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		return fmt.Errorf("user %s does not have permission to assign roles in organization %s", caller.ID, orgID)
+	}
+
+	return c.putRoleAssignment(ctx, AccountAccess{
+		UserID:   userID,
+		OrgID:    orgID,
+		RecordID: recordID,
+		Role:     Role(role),
+		Level:    AccessLevel(level),
+	})
+}
+
+// RevokeRole revokes a previously assigned role, marking it revoked rather
+// than deleting it so the assignment history remains auditable.
+func (c *EHRContract) RevokeRole(ctx contractapi.TransactionContextInterface, userID string, orgID string, recordID string) error {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	granted, err := c.hasAccessLevel(ctx, caller.ID, orgID, FullAccess)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		return fmt.Errorf("user %s does not have permission to revoke roles in organization %s", caller.ID, orgID)
+	}
+
+	key, err := roleKey(ctx, userID, orgID, recordID)
+	if err != nil {
+		return fmt.Errorf("failed to build role key: %v", err)
+	}
+
+	accessJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if accessJSON == nil {
+		return fmt.Errorf("no role assignment for user %s in organization %s", userID, orgID)
+	}
+
+	var access AccountAccess
+	if err := json.Unmarshal(accessJSON, &access); err != nil {
+		return err
+	}
+	access.Revoked = true
+
+	return c.putRoleAssignment(ctx, access)
+}
+
+// putRoleAssignment writes an AccountAccess entry to world state.
+func (c *EHRContract) putRoleAssignment(ctx contractapi.TransactionContextInterface, access AccountAccess) error {
+	key, err := roleKey(ctx, access.UserID, access.OrgID, access.RecordID)
+	if err != nil {
+		return fmt.Errorf("failed to build role key: %v", err)
+	}
+
+	accessJSON, err := json.Marshal(access)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(key, accessJSON); err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+	return nil
+}
+
+// getRoleAssignment looks up a user's (non-revoked) role assignment,
+// checking the record-scoped key first and falling back to the org-wide
+// assignment.
+func (c *EHRContract) getRoleAssignment(ctx contractapi.TransactionContextInterface, userID string, orgID string, recordID string) (*AccountAccess, error) {
+	for _, scope := range []string{recordID, ""} {
+		key, err := roleKey(ctx, userID, orgID, scope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build role key: %v", err)
+		}
+
+		accessJSON, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if accessJSON == nil {
+			continue
+		}
+
+		var access AccountAccess
+		if err := json.Unmarshal(accessJSON, &access); err != nil {
+			return nil, err
+		}
+		if !access.Revoked {
+			return &access, nil
+		}
+	}
+	return nil, nil
+}
+
+// hasAccessLevel reports whether userID holds at least the given access
+// level in orgID.
+func (c *EHRContract) hasAccessLevel(ctx contractapi.TransactionContextInterface, userID string, orgID string, level AccessLevel) (bool, error) {
+	access, err := c.getRoleAssignment(ctx, userID, orgID, "")
+	if err != nil {
+		return false, err
+	}
+	if access == nil {
+		return false, nil
+	}
+	return accessLevelRank(access.Level) >= accessLevelRank(level), nil
+}
+
+// accessLevelRank orders access levels from least to most privileged.
+func accessLevelRank(level AccessLevel) int {
+	switch level {
+	case ReadOnlyAccess:
+		return 0
+	case ContractCallAccess:
+		return 1
+	case TransactAccess:
+		return 2
+	case FullAccess:
+		return 3
+	default:
+		return -1
+	}
+}
+
+// checkAccountAccess is the ABAC gate record functions consult after their
+// own patient/doctor (and, where applicable, consent) checks. It first honors the legacy per-record permission list
+// (record owner, assigned doctor, or explicitly shared user) and, failing
+// that, consults the role registry for a doctor/nurse/researcher/auditor
+// relationship scoped to the record's organization (record.OrgID), the same
+// org a FullAccess admin must have used when calling AssignRole.
+func (c *EHRContract) checkAccountAccess(ctx contractapi.TransactionContextInterface, userID string, recordID string, action string) (bool, error) {
+	record, err := c.getRecord(ctx, recordID)
+	if err != nil {
+		return false, err
+	}
+	if record == nil {
+		return false, fmt.Errorf("record %s does not exist", recordID)
+	}
+
+	if c.hasPermission(userID, record.Permissions) {
+		return true, nil
+	}
+
+	access, err := c.getRoleAssignment(ctx, userID, record.OrgID, recordID)
+	if err != nil {
+		return false, err
+	}
+	if access == nil {
+		return false, nil
+	}
+
+	switch access.Role {
+	case RolePrimaryDoctor, RoleConsultingDoctor, RoleNurse:
+		required := ReadOnlyAccess
+		if action == "write" || action == "share" {
+			required = TransactAccess
+		}
+		return accessLevelRank(access.Level) >= accessLevelRank(required), nil
+	case RoleResearcher, RoleAuditor:
+		return action == "read", nil
+	case RoleAdmin:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// getRecord is a small helper shared with checkAccountAccess so it does not
+// have to duplicate ReadEHRRecord's logging and permission side-effects.
+func (c *EHRContract) getRecord(ctx contractapi.TransactionContextInterface, id string) (*EHRRecord, error) {
+	recordJSON, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, nil
+	}
+
+	var record EHRRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}